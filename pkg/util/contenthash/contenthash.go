@@ -0,0 +1,295 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package contenthash computes stable, recursive digests of files and
+// directories in a build context, so the executor can tell whether a
+// COPY/ADD source tree has actually changed since the last build instead
+// of re-running the instruction on every build.
+//
+// The design is loosely modeled on buildkit's cache/contenthash: results
+// are cached in an immutable radix tree keyed by cleaned, absolute,
+// unix-style paths, each holding the final digest (metadata folded
+// together with contents) plus the stat info it was computed from, so a
+// later call can tell the cache entry is still valid without re-hashing.
+package contenthash
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	iradix "github.com/hashicorp/go-immutable-radix"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// bufPool holds reusable buffers for streaming file content through sha256,
+// so Checksum-ing a large tree doesn't allocate a fresh buffer per file.
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 128*1024)
+		return &buf
+	},
+}
+
+// record is everything cached per radix key: the digest itself, plus the
+// stat metadata it was computed from, so a later call can tell whether the
+// cache entry is still valid without re-hashing anything.
+type record struct {
+	digest digest.Digest
+	mtime  int64
+	size   int64
+	mode   os.FileMode
+	inode  uint64
+}
+
+// matches reports whether fi describes the same file the record was
+// computed from.
+func (r *record) matches(fi os.FileInfo) bool {
+	if r == nil {
+		return false
+	}
+	return r.size == fi.Size() &&
+		r.mode == fi.Mode() &&
+		r.mtime == fi.ModTime().UnixNano() &&
+		r.inode == statInode(fi)
+}
+
+// store is the per-root cache: an immutable radix tree of path -> record,
+// guarded by a mutex since Checksum may be called concurrently for
+// different COPY instructions sharing the same build context.
+type store struct {
+	mu   sync.Mutex
+	tree *iradix.Tree
+}
+
+func newStore() *store {
+	return &store{tree: iradix.New()}
+}
+
+func (s *store) get(key string) (*record, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.tree.Get([]byte(key))
+	if !ok {
+		return nil, false
+	}
+	return v.(*record), true
+}
+
+func (s *store) put(key string, r *record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tree, _, _ = s.tree.Insert([]byte(key), r)
+}
+
+var (
+	storesMu sync.Mutex
+	stores   = map[string]*store{}
+)
+
+// storeForRoot returns the shared cache for a given build context root,
+// creating one on first use. Keeping one store per root (rather than one
+// global store) keeps cache keys unambiguous across concurrent builds with
+// different contexts.
+func storeForRoot(root string) *store {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	s, ok := stores[root]
+	if !ok {
+		s = newStore()
+		stores[root] = s
+	}
+	return s
+}
+
+// contentsKey turns a cleaned path into its radix key, with "/" reserved
+// for the root since "" (the root's cleaned form) isn't distinguishable
+// from "no path" otherwise.
+func contentsKey(p string) string {
+	if p == "" {
+		return "/"
+	}
+	return p
+}
+
+// cleanPath turns an OS path into the cleaned, absolute, unix-style,
+// slash-rooted form used as a radix key, e.g. "foo/../bar" -> "/bar" and
+// "" -> "" (the root).
+func cleanPath(p string) string {
+	p = filepath.ToSlash(filepath.Clean("/" + p))
+	if p == "/" {
+		return ""
+	}
+	return p
+}
+
+// Checksum computes a stable digest of the file or directory at path
+// (relative to root). Directory digests fold in the digests of every
+// child, so any change anywhere in the subtree changes the digest of every
+// ancestor directory as well. Results are cached per path and invalidated
+// by comparing stat metadata, so calling Checksum again after an
+// unrelated part of the tree changed only re-hashes what actually changed.
+//
+// If followLinks is true, a symlink at path is resolved before hashing;
+// otherwise the symlink itself (its target string) is hashed.
+func Checksum(ctx context.Context, root, path string, followLinks bool) (digest.Digest, error) {
+	s := storeForRoot(root)
+	return checksumPath(ctx, s, root, cleanPath(path), followLinks)
+}
+
+func checksumPath(ctx context.Context, s *store, root, p string, followLinks bool) (digest.Digest, error) {
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	default:
+	}
+
+	fp := filepath.Join(root, filepath.FromSlash(p))
+
+	var fi os.FileInfo
+	var err error
+	if followLinks {
+		fi, err = os.Stat(fp)
+	} else {
+		fi, err = os.Lstat(fp)
+	}
+	if err != nil {
+		return "", fmt.Errorf("contenthash: stat %s: %w", fp, err)
+	}
+
+	// A directory's own mtime doesn't reliably change when a descendant
+	// file's content is edited in place, only when entries are added,
+	// removed or renamed - so a cache hit on the directory's own stat
+	// isn't enough to skip re-checking it. Files and symlinks have no such
+	// blind spot: their content is wholly described by their own stat, so
+	// a match there is sufficient to reuse the cached digest.
+	if fi.Mode()&os.ModeDir == 0 {
+		if cached, ok := s.get(contentsKey(p)); ok && cached.matches(fi) {
+			return cached.digest, nil
+		}
+	}
+
+	headerDigest := headerDigestFor(fi)
+
+	var contentsDigest digest.Digest
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		contentsDigest = digest.FromString(fi.Mode().String())
+		target, err := os.Readlink(fp)
+		if err != nil {
+			return "", fmt.Errorf("contenthash: readlink %s: %w", fp, err)
+		}
+		contentsDigest = digest.FromString(target)
+	case fi.IsDir():
+		contentsDigest, err = checksumDir(ctx, s, root, p, followLinks)
+		if err != nil {
+			return "", err
+		}
+	default:
+		contentsDigest, err = checksumFileContents(fp)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	final := foldDigests(headerDigest, contentsDigest)
+	s.put(contentsKey(p), &record{
+		digest: final,
+		mtime:  fi.ModTime().UnixNano(),
+		size:   fi.Size(),
+		mode:   fi.Mode(),
+		inode:  statInode(fi),
+	})
+	return final, nil
+}
+
+// checksumDir folds the digests of a directory's immediate children,
+// sorted by name so the result doesn't depend on readdir order.
+func checksumDir(ctx context.Context, s *store, root, p string, followLinks bool) (digest.Digest, error) {
+	fp := filepath.Join(root, filepath.FromSlash(p))
+	entries, err := os.ReadDir(fp)
+	if err != nil {
+		return "", fmt.Errorf("contenthash: readdir %s: %w", fp, err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		childDigest, err := checksumPath(ctx, s, root, p+"/"+name, followLinks)
+		if err != nil {
+			return "", err
+		}
+		foldInto(h, name, childDigest)
+	}
+	return digest.NewDigest(digest.SHA256, h), nil
+}
+
+// checksumFileContents streams a regular file's bytes through sha256 using
+// a pooled buffer, to avoid re-allocating one per file in a large tree.
+func checksumFileContents(fp string) (digest.Digest, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return "", fmt.Errorf("contenthash: open %s: %w", fp, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	bufp := bufPool.Get().(*[]byte)
+	defer bufPool.Put(bufp)
+	if _, err := io.CopyBuffer(h, f, *bufp); err != nil {
+		return "", fmt.Errorf("contenthash: hash %s: %w", fp, err)
+	}
+	return digest.NewDigest(digest.SHA256, h), nil
+}
+
+// headerDigestFor hashes the metadata of fi that tar/OCI layers treat as
+// part of a file's identity: mode, uid and gid. Kaniko doesn't currently
+// track xattrs separately, so they aren't folded in here.
+func headerDigestFor(fi os.FileInfo) digest.Digest {
+	h := sha256.New()
+	fmt.Fprintf(h, "mode:%o", fi.Mode())
+	if uid, gid, ok := statOwner(fi); ok {
+		fmt.Fprintf(h, "uid:%d gid:%d", uid, gid)
+	}
+	return digest.NewDigest(digest.SHA256, h)
+}
+
+// foldDigests combines a path's header and contents digests into the one
+// digest callers see, so a chmod and a content edit both invalidate it.
+func foldDigests(header, contents digest.Digest) digest.Digest {
+	h := sha256.New()
+	io.WriteString(h, header.String())
+	io.WriteString(h, contents.String())
+	return digest.NewDigest(digest.SHA256, h)
+}
+
+// foldInto folds a named child's digest into a running directory hash.
+func foldInto(h hash.Hash, name string, d digest.Digest) {
+	io.WriteString(h, name)
+	h.Write([]byte{0})
+	io.WriteString(h, d.String())
+	h.Write([]byte{0})
+}
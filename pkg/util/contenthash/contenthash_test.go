@@ -0,0 +1,102 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package contenthash
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func TestChecksumStableAcrossCalls(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	files := map[string]string{
+		"/src/a.txt":    "hello",
+		"/src/b.txt":    "world",
+		"/src/nested/c": "nested contents",
+	}
+	if err := testutil.SetupFiles(root, files); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := Checksum(context.Background(), root, "/src", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Checksum(context.Background(), root, "/src", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckErrorAndDeepEqual(t, false, nil, first, second)
+}
+
+func TestChecksumChangesWithContent(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := testutil.SetupFiles(root, map[string]string{"/src/a.txt": "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	before, err := Checksum(context.Background(), root, "/src", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := filepath.Join(root, "src", "a.txt")
+	if err := ioutil.WriteFile(changed, []byte("goodbye"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Force a distinct mtime so the change is observable even on
+	// filesystems with coarse mtime resolution.
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(changed, future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := Checksum(context.Background(), root, "/src", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before == after {
+		t.Fatalf("expected digest to change after editing file content, got same digest %s", before)
+	}
+}
+
+func TestChecksumUnknownPath(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if _, err := Checksum(context.Background(), root, "/does-not-exist", false); err == nil {
+		t.Fatal("expected an error checksumming a path that doesn't exist")
+	}
+}
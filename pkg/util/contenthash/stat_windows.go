@@ -0,0 +1,31 @@
+//go:build windows
+
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package contenthash
+
+import "os"
+
+// statInode and statOwner have no equivalent on Windows; invalidation there
+// falls back to mtime/size/mode alone.
+func statInode(fi os.FileInfo) uint64 {
+	return 0
+}
+
+func statOwner(fi os.FileInfo) (uid, gid uint32, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package contenthash
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// ChecksumWildcard computes one stable digest across every path under root
+// that matches pattern, using filepath.Match glob semantics (plus "**" for
+// matching across directory boundaries). This lets a COPY source like
+// "src/*.go" produce a single cache key regardless of how many files
+// currently match it, superseding RelativeFiles for callers that need a
+// cache key rather than a plain file listing.
+//
+// Matches are folded in lexicographic order of their path relative to
+// root, with that relative path folded in alongside each match's digest —
+// so renaming a matched file invalidates the wildcard digest even if its
+// content is unchanged. An unmatched pattern is an error, consistent with
+// how the Dockerfile COPY/ADD instructions already treat a wildcard with
+// no matches.
+func ChecksumWildcard(ctx context.Context, root, pattern string, followLinks bool) (digest.Digest, error) {
+	clean := cleanPath(pattern)
+	matches, err := wildcardMatches(root, clean)
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("contenthash: pattern %q matched no files in %s", pattern, root)
+	}
+	sort.Strings(matches)
+
+	h := sha256.New()
+	s := storeForRoot(root)
+	for _, m := range matches {
+		d, err := checksumPath(ctx, s, root, m, followLinks)
+		if err != nil {
+			return "", err
+		}
+		foldInto(h, m, d)
+	}
+	return digest.NewDigest(digest.SHA256, h), nil
+}
+
+// wildcardMatches walks root and returns the cleaned, root-relative path of
+// every entry that matches pattern.
+func wildcardMatches(root, pattern string) ([]string, error) {
+	var matches []string
+	err := filepath.Walk(root, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, fp)
+		if err != nil {
+			return err
+		}
+		p := cleanPath(rel)
+		if p == "" {
+			return nil
+		}
+		ok, err := matchPattern(pattern, p)
+		if err != nil {
+			return err
+		}
+		if ok {
+			matches = append(matches, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+// matchPattern reports whether p matches pattern. filepath.Match already
+// covers "*", "?" and character classes; "**" (match across any number of
+// path segments) isn't something filepath.Match supports, so patterns
+// containing it fall back to a translated regexp.
+func matchPattern(pattern, p string) (bool, error) {
+	if !strings.Contains(pattern, "**") {
+		return filepath.Match(pattern, p)
+	}
+	re, err := globToRegexp(pattern)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(p), nil
+}
+
+// globToRegexp translates a filepath.Match-style glob that may contain
+// "**" into an equivalent anchored regexp.
+func globToRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '*' && i+1 < len(pattern) && pattern[i+1] == '*':
+			if i+2 < len(pattern) && pattern[i+2] == '/' {
+				// "**/" also matches zero directories, so "src/**/*.go"
+				// covers "src/a.go" as well as "src/sub/c.go".
+				b.WriteString("(?:.*/)?")
+				i += 2
+			} else {
+				b.WriteString(".*")
+				i++
+			}
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			i, _ = writeCharClass(&b, pattern, i)
+		case c == '\\' && i+1 < len(pattern):
+			b.WriteString(regexp.QuoteMeta(pattern[i+1 : i+2]))
+			i++
+		case strings.ContainsRune(`.+()|{}^$\`, rune(c)):
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// writeCharClass copies a glob character class starting at pattern[start]
+// (which must be '[') into b as the equivalent regexp class, translating
+// glob's "!" negation to regexp's "^" - without this, "[!a]" would pass
+// through unchanged into a Go regexp, where "!" is just another literal
+// member of the class rather than a negation, silently inverting the match.
+// It returns the index of the class's closing ']', or of '[' itself if the
+// class is unterminated (in which case '[' is emitted as a literal).
+func writeCharClass(b *strings.Builder, pattern string, start int) (end int, negate bool) {
+	j := start + 1
+	if j < len(pattern) && pattern[j] == '!' {
+		negate = true
+		j++
+	}
+	end = j
+	for end < len(pattern) && pattern[end] != ']' {
+		end++
+	}
+	if end >= len(pattern) {
+		b.WriteString(`\[`)
+		return start, false
+	}
+
+	b.WriteByte('[')
+	if negate {
+		b.WriteByte('^')
+	}
+	class := pattern[j:end]
+	if !negate && strings.HasPrefix(class, "^") {
+		// A literal leading "^" in a non-negated glob class must be
+		// escaped, or the regexp engine would read it as negation.
+		b.WriteString(`\^`)
+		class = class[1:]
+	}
+	b.WriteString(class)
+	b.WriteByte(']')
+	return end, negate
+}
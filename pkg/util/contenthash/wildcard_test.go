@@ -0,0 +1,169 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package contenthash
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func setupWildcardTree(t *testing.T) string {
+	t.Helper()
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	files := map[string]string{
+		"src/a.go":      "package src\n",
+		"src/b.go":      "package src\n\nfunc B() {}\n",
+		"src/readme.md": "not go\n",
+		"src/sub/c.go":  "package sub\n",
+		"src/sub/d.txt": "not go\n",
+	}
+	for rel, contents := range files {
+		p := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestChecksumWildcardStarMatchesOneLevel(t *testing.T) {
+	root := setupWildcardTree(t)
+
+	d1, err := ChecksumWildcard(context.Background(), root, "src/*.go", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := ChecksumWildcard(context.Background(), root, "src/*.go", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d1 != d2 {
+		t.Fatalf("expected stable digest, got %s != %s", d1, d2)
+	}
+
+	matches, err := wildcardMatches(root, cleanPath("src/*.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(matches)
+	want := []string{"/src/a.go", "/src/b.go"}
+	if !reflect.DeepEqual(matches, want) {
+		t.Fatalf("src/*.go matched %v, want %v", matches, want)
+	}
+}
+
+func TestChecksumWildcardDoubleStarCrossesDirectories(t *testing.T) {
+	root := setupWildcardTree(t)
+
+	shallow, err := ChecksumWildcard(context.Background(), root, "src/*.go", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deep, err := ChecksumWildcard(context.Background(), root, "src/**/*.go", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shallow == deep {
+		t.Fatalf("expected src/**/*.go to cover src/sub/c.go as well, got identical digest to src/*.go")
+	}
+}
+
+func TestChecksumWildcardCharacterClass(t *testing.T) {
+	root := setupWildcardTree(t)
+
+	d, err := ChecksumWildcard(context.Background(), root, "src/[ab].go", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == "" {
+		t.Fatal("expected a non-empty digest")
+	}
+}
+
+func TestChecksumWildcardNoMatches(t *testing.T) {
+	root := setupWildcardTree(t)
+
+	if _, err := ChecksumWildcard(context.Background(), root, "src/*.rs", false); err == nil {
+		t.Fatal("expected an error for a pattern with no matches")
+	}
+}
+
+func TestChecksumWildcardDoubleStarWithNegatedClass(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	files := map[string]string{
+		"src/sub/a.go": "package sub\n",
+		"src/sub/b.go": "package sub\n",
+	}
+	for rel, contents := range files {
+		p := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	matches, err := wildcardMatches(root, cleanPath("src/**/[!a]*.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(matches)
+	want := []string{"/src/sub/b.go"}
+	if len(matches) != len(want) || matches[0] != want[0] {
+		t.Fatalf("src/**/[!a]*.go matched %v, want %v", matches, want)
+	}
+}
+
+func TestChecksumWildcardChangesUnderRename(t *testing.T) {
+	root := setupWildcardTree(t)
+
+	before, err := ChecksumWildcard(context.Background(), root, "src/*.go", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Rename(filepath.Join(root, "src", "a.go"), filepath.Join(root, "src", "z.go")); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := ChecksumWildcard(context.Background(), root, "src/*.go", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before == after {
+		t.Fatalf("expected renaming a matched file to change the wildcard digest")
+	}
+}
@@ -0,0 +1,340 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// WhiteoutPrefix is the prefix of whiteout files and directories.
+	WhiteoutPrefix = ".wh."
+	// whiteoutOpaqueDir marks a directory as "opaque": every entry that
+	// was in the directory in a lower layer should be hidden, but the
+	// directory itself stays. See the OCI image spec's opaque whiteout
+	// convention (originally overlayfs's).
+	whiteoutOpaqueDir = ".wh..wh..opq"
+)
+
+// whiteoutKind distinguishes a regular whiteout, which hides the path it's
+// recorded against (and everything under it), from an opaque-directory
+// whiteout, which hides only that directory's children.
+type whiteoutKind int
+
+const (
+	whiteoutRegular whiteoutKind = iota
+	whiteoutOpaque
+)
+
+// parseWhiteout classifies a tar entry by its directory and base name,
+// per the overlayfs/OCI convention: "<dir>/.wh..wh..opq" marks dir itself
+// as opaque, while "<dir>/.wh.<name>" marks "<dir>/<name>" as removed. ok
+// is false if name isn't a whiteout marker at all.
+//
+// NOTE: no code in this tree walks a tar layer and fills the whiteouts map
+// that checkWhiteouts consults; parseWhiteout and checkWhiteouts are called
+// only from tests.
+func parseWhiteout(dir, name string) (path string, kind whiteoutKind, ok bool) {
+	if name == whiteoutOpaqueDir {
+		return dir, whiteoutOpaque, true
+	}
+	if strings.HasPrefix(name, WhiteoutPrefix) {
+		return filepath.Join(dir, strings.TrimPrefix(name, WhiteoutPrefix)), whiteoutRegular, true
+	}
+	return "", 0, false
+}
+
+// fileSystemWhitelist returns the list of paths that should never be
+// included in a filesystem snapshot, based on the mountinfo at path.
+func fileSystemWhitelist(path string) ([]string, error) {
+	whitelist := []string{"/kaniko", "/var/run"}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		lineArr := strings.Split(line, " ")
+		if len(lineArr) < 5 {
+			continue
+		}
+		mountPoint := filepath.Clean(lineArr[4])
+		if mountPoint == "/" {
+			// The root mount covers the whole filesystem; whitelisting it
+			// would mean nothing ever gets snapshotted.
+			continue
+		}
+		whitelist = append(whitelist, mountPoint)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return whitelist, nil
+}
+
+// RelativeFiles returns a list of all files at the filepath fp relative to root.
+//
+// For callers that need a cache key rather than a plain listing (e.g. to
+// decide whether a COPY/ADD source has changed), prefer
+// contenthash.Checksum or contenthash.ChecksumWildcard instead.
+func RelativeFiles(fp string, root string) ([]string, error) {
+	var files []string
+	fullPath := filepath.Join(root, fp)
+	err := filepath.Walk(fullPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, relPath)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// ParentDirectories returns a list of paths to all parent directories of path,
+// not including path itself and not including the root "/".
+func ParentDirectories(path string) []string {
+	dir := filepath.Clean(path)
+	var paths []string
+	for {
+		dir = filepath.Dir(dir)
+		if dir == "/" || dir == "." {
+			break
+		}
+		paths = append([]string{dir}, paths...)
+	}
+	return paths
+}
+
+// checkWhiteouts returns true if path is hidden by whiteouts: either path
+// itself (or one of its parent directories) was removed by a regular
+// whiteout, or one of its parent directories is recorded as opaque, which
+// hides its children without hiding the directory itself.
+func checkWhiteouts(path string, whiteouts map[string]whiteoutKind) bool {
+	path = filepath.Clean(path)
+	if kind, ok := whiteouts[path]; ok && kind == whiteoutRegular {
+		return true
+	}
+	for _, dir := range ParentDirectories(path) {
+		if _, ok := whiteouts[dir]; ok {
+			// Whether dir was recorded as a regular or an opaque
+			// whiteout, path is a descendant of it and so is hidden.
+			return true
+		}
+	}
+	return false
+}
+
+// checkWhitelist returns true if path, or any of its parent directories,
+// appear in the whitelist.
+func checkWhitelist(path string, whitelist []string) bool {
+	path = filepath.Clean(path)
+	for _, w := range whitelist {
+		w = filepath.Clean(w)
+		if path == w {
+			return true
+		}
+		for _, dir := range ParentDirectories(path) {
+			if dir == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// HasFilepathPrefix returns true if path starts with prefix, treating both
+// as cleaned filesystem paths rather than raw strings (so "/foo2" is not
+// considered to have the prefix "/foo").
+func HasFilepathPrefix(path, prefix string) bool {
+	path = filepath.Clean(path)
+	prefix = filepath.Clean(prefix)
+	if path == prefix {
+		return true
+	}
+	return strings.HasPrefix(path, prefix+string(filepath.Separator))
+}
+
+// MkdirAllWithPermissions creates a directory at path, as well as any
+// necessary parents, with the given permissions, uid and gid.
+func MkdirAllWithPermissions(path string, mode os.FileMode, uid, gid int64) error {
+	if err := os.MkdirAll(path, mode); err != nil {
+		return err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	if err := os.Chown(path, int(uid), int(gid)); err != nil {
+		logrus.Debugf("error chowning %s to %d:%d: %v", path, uid, gid, err)
+	}
+	return nil
+}
+
+// extractFile extracts a single tar entry to dest. It guards against the
+// path-traversal and symlink-breakout techniques tracked by the moby
+// archive package: header names that clean to somewhere outside dest,
+// hardlinks whose target resolves outside dest, entries that reach through
+// a symlink planted by an earlier entry in the same archive (e.g. a
+// "loophole" symlink followed by a write to a path under it), and a
+// symlink planted at the exact path of a later entry, which would
+// otherwise have this entry's own creation calls (os.OpenFile and
+// os.MkdirAll follow an existing symlink rather than replacing it) write
+// straight through it.
+func extractFile(dest string, hdr *tar.Header, tr io.Reader) error {
+	root := filepath.Clean(dest)
+	path := filepath.Join(root, filepath.Clean(string(filepath.Separator)+hdr.Name))
+	if !HasFilepathPrefix(path, root) {
+		return fmt.Errorf("%s is outside of the extraction root %s", hdr.Name, root)
+	}
+	base := filepath.Dir(path)
+	if err := resolveParentNoEscape(root, base); err != nil {
+		return err
+	}
+	if existing, err := os.Lstat(path); err == nil && existing.Mode()&os.ModeSymlink != 0 {
+		// A previous entry in this archive planted a symlink at this exact
+		// path. Remove it rather than letting this entry's creation calls
+		// follow it and write through to wherever it points.
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("removing symlink planted at %s before extracting %s: %w", path, hdr.Name, err)
+		}
+	}
+
+	mode := hdr.FileInfo().Mode()
+	uid := int64(hdr.Uid)
+	gid := int64(hdr.Gid)
+
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		if err := MkdirAllWithPermissions(base, 0755, uid, gid); err != nil {
+			return err
+		}
+		currFile, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(currFile, tr); err != nil {
+			currFile.Close()
+			return err
+		}
+		currFile.Close()
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+		if err := os.Chown(path, int(uid), int(gid)); err != nil {
+			logrus.Debugf("error chowning %s to %d:%d: %v", path, uid, gid, err)
+		}
+
+	case tar.TypeDir:
+		if err := MkdirAllWithPermissions(path, mode, uid, gid); err != nil {
+			return err
+		}
+
+	case tar.TypeLink:
+		// Linkname names a path inside the archive being extracted, so
+		// it's always resolved against root - never against base, and an
+		// absolute Linkname isn't treated as rooted at "/": Join doesn't
+		// special-case a leading separator on a later argument, so
+		// Join(root, "/etc/passwd") lands at "<root>/etc/passwd", same as
+		// a relative Linkname would. A ".." that walks back out past
+		// root is still caught by the HasFilepathPrefix check below.
+		//
+		// We then create a real hardlink to that resolved, validated
+		// path rather than emulating one with a symlink: a symlink would
+		// carry Linkname onto disk verbatim, so an absolute Linkname like
+		// "/etc/passwd" would still resolve to the real host file the
+		// moment anything (kaniko's own snapshotting included)
+		// dereferenced it without a chroot. A real hardlink can't do
+		// that - it can only ever resolve to the inode at the target
+		// path we've already validated.
+		target := filepath.Clean(filepath.Join(root, hdr.Linkname))
+		if !HasFilepathPrefix(target, root) {
+			return fmt.Errorf("hardlink %s -> %s resolves outside of the extraction root %s", hdr.Name, hdr.Linkname, root)
+		}
+		if err := resolveParentNoEscape(root, filepath.Dir(target)); err != nil {
+			return err
+		}
+		if targetInfo, err := os.Lstat(target); err == nil && targetInfo.Mode()&os.ModeSymlink != 0 {
+			// os.Link doesn't dereference a symlink target - it links
+			// straight to the symlink's own inode, giving the new path a
+			// second name for whatever that symlink points to. That would
+			// smuggle an escape straight through the containment checks
+			// above, the same way a planted symlink does for a regular
+			// write (see the Lstat check at the top of this function).
+			return fmt.Errorf("hardlink %s -> %s targets a symlink, not a real file", hdr.Name, hdr.Linkname)
+		}
+		if err := MkdirAllWithPermissions(base, 0755, uid, gid); err != nil {
+			return err
+		}
+		if err := os.Link(target, path); err != nil {
+			return err
+		}
+
+	case tar.TypeSymlink:
+		if err := MkdirAllWithPermissions(base, 0755, uid, gid); err != nil {
+			return err
+		}
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveParentNoEscape walks from root down to dir, resolving symlinks
+// along the way, and fails if any prefix of dir has come to resolve outside
+// root. This is what stops the "loophole" pattern, where one entry creates
+// a symlink (e.g. loophole-victim -> ../victim) and a later entry in the
+// same archive writes through it as loophole-victim/file.
+func resolveParentNoEscape(root, dir string) error {
+	if !HasFilepathPrefix(dir, root) {
+		return fmt.Errorf("%s is outside of the extraction root %s", dir, root)
+	}
+	if dir == root {
+		return nil
+	}
+	if err := resolveParentNoEscape(root, filepath.Dir(dir)); err != nil {
+		return err
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if !HasFilepathPrefix(resolved, root) {
+		return fmt.Errorf("%s resolves to %s, outside of the extraction root %s", dir, resolved, root)
+	}
+	return nil
+}
@@ -167,7 +167,7 @@ func Test_ParentDirectories(t *testing.T) {
 func Test_checkWhiteouts(t *testing.T) {
 	type args struct {
 		path      string
-		whiteouts map[string]struct{}
+		whiteouts map[string]whiteoutKind
 	}
 	tests := []struct {
 		name string
@@ -178,7 +178,7 @@ func Test_checkWhiteouts(t *testing.T) {
 			name: "file whited out",
 			args: args{
 				path:      "/foo",
-				whiteouts: map[string]struct{}{"/foo": {}},
+				whiteouts: map[string]whiteoutKind{"/foo": whiteoutRegular},
 			},
 			want: true,
 		},
@@ -186,7 +186,7 @@ func Test_checkWhiteouts(t *testing.T) {
 			name: "directory whited out",
 			args: args{
 				path:      "/foo/bar",
-				whiteouts: map[string]struct{}{"/foo": {}},
+				whiteouts: map[string]whiteoutKind{"/foo": whiteoutRegular},
 			},
 			want: true,
 		},
@@ -194,7 +194,7 @@ func Test_checkWhiteouts(t *testing.T) {
 			name: "grandparent whited out",
 			args: args{
 				path:      "/foo/bar/baz",
-				whiteouts: map[string]struct{}{"/foo": {}},
+				whiteouts: map[string]whiteoutKind{"/foo": whiteoutRegular},
 			},
 			want: true,
 		},
@@ -202,7 +202,47 @@ func Test_checkWhiteouts(t *testing.T) {
 			name: "sibling whited out",
 			args: args{
 				path:      "/foo/bar/baz",
-				whiteouts: map[string]struct{}{"/foo/bat": {}},
+				whiteouts: map[string]whiteoutKind{"/foo/bat": whiteoutRegular},
+			},
+			want: false,
+		},
+		{
+			name: "opaque parent hides children",
+			args: args{
+				path:      "/foo/bar",
+				whiteouts: map[string]whiteoutKind{"/foo": whiteoutOpaque},
+			},
+			want: true,
+		},
+		{
+			name: "opaque parent hides grandchildren",
+			args: args{
+				path:      "/foo/bar/baz",
+				whiteouts: map[string]whiteoutKind{"/foo": whiteoutOpaque},
+			},
+			want: true,
+		},
+		{
+			name: "opaque parent does not hide itself",
+			args: args{
+				path:      "/foo",
+				whiteouts: map[string]whiteoutKind{"/foo": whiteoutOpaque},
+			},
+			want: false,
+		},
+		{
+			name: "opaque parent plus explicit child whiteout compose",
+			args: args{
+				path:      "/foo/bar",
+				whiteouts: map[string]whiteoutKind{"/foo": whiteoutOpaque, "/foo/bar": whiteoutRegular},
+			},
+			want: true,
+		},
+		{
+			name: "opaque parent does not hide itself even with explicit child whiteout present",
+			args: args{
+				path:      "/foo",
+				whiteouts: map[string]whiteoutKind{"/foo": whiteoutOpaque, "/foo/bar": whiteoutRegular},
 			},
 			want: false,
 		},
@@ -216,6 +256,54 @@ func Test_checkWhiteouts(t *testing.T) {
 	}
 }
 
+func Test_parseWhiteout(t *testing.T) {
+	tests := []struct {
+		name     string
+		dir      string
+		base     string
+		wantPath string
+		wantKind whiteoutKind
+		wantOk   bool
+	}{
+		{
+			name:     "regular whiteout",
+			dir:      "/foo",
+			base:     ".wh.bar",
+			wantPath: "/foo/bar",
+			wantKind: whiteoutRegular,
+			wantOk:   true,
+		},
+		{
+			name:     "opaque whiteout",
+			dir:      "/foo",
+			base:     ".wh..wh..opq",
+			wantPath: "/foo",
+			wantKind: whiteoutOpaque,
+			wantOk:   true,
+		},
+		{
+			name:   "not a whiteout",
+			dir:    "/foo",
+			base:   "bar",
+			wantOk: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, kind, ok := parseWhiteout(tt.dir, tt.base)
+			if ok != tt.wantOk {
+				t.Fatalf("parseWhiteout() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if !ok {
+				return
+			}
+			if path != tt.wantPath || kind != tt.wantKind {
+				t.Errorf("parseWhiteout() = (%q, %v), want (%q, %v)", path, kind, tt.wantPath, tt.wantKind)
+			}
+		})
+	}
+}
+
 func Test_checkWhitelist(t *testing.T) {
 	type args struct {
 		path      string
@@ -376,6 +464,22 @@ func linkPointsTo(src, dst string) checker {
 	}
 }
 
+func hardlinkMatches(src, dst string) checker {
+	return func(root string, t *testing.T) {
+		srcInfo, err := os.Stat(filepath.Join(root, src))
+		if err != nil {
+			t.Fatalf("error statting %s: %s", src, err)
+		}
+		dstInfo, err := os.Stat(filepath.Join(root, dst))
+		if err != nil {
+			t.Fatalf("error statting %s: %s", dst, err)
+		}
+		if !os.SameFile(srcInfo, dstInfo) {
+			t.Errorf("%s is not a hardlink to %s", src, dst)
+		}
+	}
+}
+
 func fileHeader(name string, contents string, mode int64) *tar.Header {
 	return &tar.Header{
 		Name:     name,
@@ -493,7 +597,7 @@ func TestExtractFile(t *testing.T) {
 				hardlinkHeader("/bin/uncompress", "/bin/gzip"),
 			},
 			checkers: []checker{
-				linkPointsTo("/bin/uncompress", "/bin/gzip"),
+				hardlinkMatches("/bin/uncompress", "/bin/gzip"),
 			},
 		},
 	}
@@ -518,3 +622,116 @@ func TestExtractFile(t *testing.T) {
 		})
 	}
 }
+
+func TestExtractFileBreakouts(t *testing.T) {
+	// wantReject is true for breakout shapes that have no safe rewrite:
+	// extractFile must refuse them outright. The ".."-in-name shapes are
+	// instead neutralized by rooting the cleaned path under dest (the
+	// entry is written inside the extraction root rather than rejected),
+	// matching how moby/archive handles them.
+	tcs := []struct {
+		name       string
+		hdrs       []*tar.Header
+		wantReject bool
+		check      func(r string, t *testing.T)
+	}{
+		{
+			name: "passing baseline",
+			hdrs: []*tar.Header{
+				fileHeader("./foo/bar", "helloworld", 0644),
+			},
+		},
+		{
+			name: "symlink then same-name overwrite",
+			hdrs: []*tar.Header{
+				linkHeader("evil", "../victim/hello"),
+				fileHeader("evil", "pwned", 0644),
+			},
+			check: func(r string, t *testing.T) {
+				fi, err := os.Lstat(filepath.Join(r, "evil"))
+				if err != nil {
+					t.Fatalf("evil: %v", err)
+				}
+				if fi.Mode()&os.ModeSymlink != 0 {
+					t.Fatalf("evil is still a symlink; the second entry wrote through it instead of replacing it")
+				}
+				fileMatches("/evil", []byte("pwned"))(r, t)
+			},
+		},
+		{
+			name: "dotdot in name",
+			hdrs: []*tar.Header{
+				fileHeader("../victim/dotdot", "pwned", 0644),
+			},
+		},
+		{
+			name: "slash dotdot in name",
+			hdrs: []*tar.Header{
+				fileHeader("/../victim/slash-dotdot", "pwned", 0644),
+			},
+		},
+		{
+			name: "hardlink escapes root",
+			hdrs: []*tar.Header{
+				hardlinkHeader("bad-link", "../victim/hello"),
+			},
+			wantReject: true,
+		},
+		{
+			name: "hardlink escapes root via nested entry",
+			hdrs: []*tar.Header{
+				hardlinkHeader("sub/bad-link", "../victim/hello"),
+			},
+			wantReject: true,
+		},
+		{
+			name: "hardlink targets a planted symlink",
+			hdrs: []*tar.Header{
+				linkHeader("evil-link", "../victim/hello"),
+				hardlinkHeader("dup-link", "evil-link"),
+			},
+			wantReject: true,
+		},
+		{
+			name: "loophole symlink then write through it",
+			hdrs: []*tar.Header{
+				linkHeader("loophole-victim", "../victim"),
+				fileHeader("loophole-victim/file", "pwned", 0644),
+			},
+			wantReject: true,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			tc := tc
+			t.Parallel()
+			r, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(r)
+
+			var lastErr error
+			for _, hdr := range tc.hdrs {
+				lastErr = extractFile(r, hdr, bytes.NewReader([]byte("pwned")))
+				if lastErr != nil {
+					break
+				}
+			}
+
+			if tc.wantReject && lastErr == nil {
+				t.Fatalf("expected breakout attempt %q to be rejected, but it succeeded", tc.name)
+			}
+			if !tc.wantReject && lastErr != nil {
+				t.Fatalf("expected %q to be handled safely rather than rejected, got: %v", tc.name, lastErr)
+			}
+			if _, statErr := os.Lstat(filepath.Join(filepath.Dir(r), "victim")); statErr == nil {
+				t.Fatalf("breakout attempt %q escaped the extraction root", tc.name)
+			}
+			if tc.check != nil && lastErr == nil {
+				tc.check(r, t)
+			}
+		})
+	}
+}